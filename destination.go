@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// Destination is a secondary git host to keep a full mirror of every
+// synced repo on, e.g. a self-hosted Gitea or GitLab kept in sync with
+// a user's GitHub stars.
+type Destination struct {
+	Name      string `json:"name"`
+	Kind      string `json:"kind"` // gitea, gitlab, generic-git
+	BaseURL   string `json:"base_url"`
+	Token     string `json:"token"`
+	OrgOrUser string `json:"org_or_user"`
+}
+
+// pushToDestinations mirrors localDir's refs to every configured
+// destination after a successful fetch.
+func pushToDestinations(localDir string, repo Repo) {
+	for _, dest := range cfg.Destinations {
+		if err := pushMirror(dest, localDir, repo); err != nil {
+			lg.Printf("[error] push mirror to %v failed for %v: %v", dest.Name, repo.FullName, err)
+		}
+	}
+}
+
+func pushMirror(dest Destination, localDir string, repo Repo) error {
+	repoName := path.Base(repo.FullName)
+
+	pushURL, authHeader, err := ensureDestRepo(dest, repoName)
+	if err != nil {
+		return fmt.Errorf("ensure repo: %w", err)
+	}
+
+	remote := "dst-" + dest.Name
+	removeRemoteIfExists(localDir, remote)
+	if err := doExec(localDir, "git", "remote", "add", remote, pushURL); err != nil {
+		return fmt.Errorf("add remote: %w", err)
+	}
+	if err := doExecEnv(localDir, authHeaderEnv(authHeader), "git", "push", "--mirror", remote); err != nil {
+		return fmt.Errorf("push mirror: %w", err)
+	}
+
+	return nil
+}
+
+// removeRemoteIfExists drops a stale remote before re-adding it. It's
+// expected to fail the first time a repo is pushed to a given
+// destination (the remote doesn't exist yet), so it bypasses doExec's
+// retry policy entirely instead of burning a full backoff sequence on an
+// operation that was never going to succeed.
+func removeRemoteIfExists(localDir, remote string) {
+	cmd := exec.Command("git", "remote", "remove", remote)
+	cmd.Dir = localDir
+	cmd.Run()
+}
+
+// authHeaderEnv carries a git HTTP Authorization header via the
+// process environment (GIT_CONFIG_*, supported since git 2.31) rather
+// than argv or the remote URL, so the destination token never lands in
+// doExec's logged command line, git's own stdout/stderr, or the repo's
+// on-disk .git/config.
+func authHeaderEnv(authHeader string) []string {
+	if authHeader == "" {
+		return nil
+	}
+	return []string{
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http.extraHeader",
+		"GIT_CONFIG_VALUE_0=Authorization: " + authHeader,
+	}
+}
+
+func basicAuthHeader(user, pass string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+}
+
+// ensureDestRepo creates repoName on a gitea or gitlab dest if it doesn't
+// already exist (generic-git destinations are never created), returning a
+// push URL (with no embedded credentials) and the Authorization header
+// needed to push to it.
+func ensureDestRepo(dest Destination, repoName string) (pushURL, authHeader string, err error) {
+	switch dest.Kind {
+	case "gitea":
+		return ensureGiteaRepo(dest, repoName)
+	case "gitlab":
+		return ensureGitLabRepo(dest, repoName)
+	case "generic-git":
+		return genericGitURL(dest, repoName)
+	default:
+		return "", "", fmt.Errorf("unknown destination kind: %v", dest.Kind)
+	}
+}
+
+func ensureGiteaRepo(dest Destination, repoName string) (string, string, error) {
+	client := &http.Client{}
+
+	checkURL := fmt.Sprintf("%v/api/v1/repos/%v/%v", dest.BaseURL, dest.OrgOrUser, repoName)
+	req, _ := http.NewRequest("GET", checkURL, nil)
+	req.Header.Set("Authorization", "token "+dest.Token)
+	rsp, err := client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	rsp.Body.Close()
+
+	if rsp.StatusCode == http.StatusNotFound {
+		lg.Printf("gitea: repo %v/%v not found on %v, creating", dest.OrgOrUser, repoName, dest.Name)
+		body, _ := json.Marshal(map[string]interface{}{
+			"name":    repoName,
+			"private": true,
+		})
+		createURL := fmt.Sprintf("%v/api/v1/orgs/%v/repos", dest.BaseURL, dest.OrgOrUser)
+		req, _ = http.NewRequest("POST", createURL, bytes.NewReader(body))
+		req.Header.Set("Authorization", "token "+dest.Token)
+		req.Header.Set("Content-Type", "application/json")
+		rsp, err = client.Do(req)
+		if err != nil {
+			return "", "", err
+		}
+		defer rsp.Body.Close()
+		if rsp.StatusCode != http.StatusCreated {
+			return "", "", fmt.Errorf("gitea create repo failed, status: %v", rsp.Status)
+		}
+	}
+
+	base := strings.TrimPrefix(dest.BaseURL, "https://")
+	base = strings.TrimPrefix(base, "http://")
+	pushURL := fmt.Sprintf("https://%v/%v/%v.git", base, dest.OrgOrUser, repoName)
+	return pushURL, basicAuthHeader(dest.OrgOrUser, dest.Token), nil
+}
+
+func ensureGitLabRepo(dest Destination, repoName string) (string, string, error) {
+	client := &http.Client{}
+
+	projectPath := url.QueryEscape(dest.OrgOrUser + "/" + repoName)
+	checkURL := fmt.Sprintf("%v/api/v4/projects/%v", dest.BaseURL, projectPath)
+	req, _ := http.NewRequest("GET", checkURL, nil)
+	req.Header.Set("PRIVATE-TOKEN", dest.Token)
+	rsp, err := client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	rsp.Body.Close()
+
+	if rsp.StatusCode == http.StatusNotFound {
+		lg.Printf("gitlab: project %v/%v not found on %v, creating", dest.OrgOrUser, repoName, dest.Name)
+		body, _ := json.Marshal(map[string]interface{}{
+			"name":       repoName,
+			"path":       repoName,
+			"visibility": "private",
+		})
+		createURL := fmt.Sprintf("%v/api/v4/projects", dest.BaseURL)
+		req, _ = http.NewRequest("POST", createURL, bytes.NewReader(body))
+		req.Header.Set("PRIVATE-TOKEN", dest.Token)
+		req.Header.Set("Content-Type", "application/json")
+		rsp, err = client.Do(req)
+		if err != nil {
+			return "", "", err
+		}
+		defer rsp.Body.Close()
+		if rsp.StatusCode != http.StatusCreated {
+			return "", "", fmt.Errorf("gitlab create project failed, status: %v", rsp.Status)
+		}
+	}
+
+	base := strings.TrimPrefix(dest.BaseURL, "https://")
+	base = strings.TrimPrefix(base, "http://")
+	pushURL := fmt.Sprintf("https://%v/%v/%v.git", base, dest.OrgOrUser, repoName)
+	return pushURL, basicAuthHeader("oauth2", dest.Token), nil
+}
+
+// genericGitURL builds a push URL by convention; generic-git destinations
+// don't expose a create API, so the target repo must already exist.
+func genericGitURL(dest Destination, repoName string) (string, string, error) {
+	base := strings.TrimPrefix(dest.BaseURL, "https://")
+	base = strings.TrimPrefix(base, "http://")
+	pushURL := fmt.Sprintf("https://%v/%v/%v.git", base, dest.OrgOrUser, repoName)
+	if dest.Token == "" {
+		return pushURL, "", nil
+	}
+	return pushURL, basicAuthHeader(dest.OrgOrUser, dest.Token), nil
+}
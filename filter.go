@@ -0,0 +1,62 @@
+package main
+
+import "path"
+
+// filterRepos applies cfg's SkipForks, SkipArchived and glob Filters to
+// the repos fetched from the API, so we don't waste worker-pool time
+// cloning/pulling repos the user doesn't want mirrored.
+func filterRepos(repos []Repo) []Repo {
+	out := make([]Repo, 0, len(repos))
+	for _, r := range repos {
+		if cfg.SkipForks && r.Fork {
+			continue
+		}
+		if cfg.SkipArchived && r.Archived {
+			continue
+		}
+		if !matchesFilters(r.FullName, cfg.Filters) {
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// matchesFilters applies an ordered list of glob patterns to name, e.g.
+// ["owner/*", "!owner/secret-*"]. A leading "!" excludes matches. A repo
+// matches if no pattern list is given, or if the last pattern that
+// matches it is an include. When nothing matches, the repo is included
+// only if the list contains no include patterns (an exclude-only list).
+func matchesFilters(name string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	include := true
+	matched := false
+	hasIncludePattern := false
+	for _, p := range patterns {
+		exclude := false
+		if len(p) > 0 && p[0] == '!' {
+			exclude = true
+			p = p[1:]
+		} else {
+			hasIncludePattern = true
+		}
+		ok, err := path.Match(p, name)
+		if err != nil || !ok {
+			continue
+		}
+		matched = true
+		include = !exclude
+	}
+
+	if !matched {
+		// Nothing matched: an exclude-only list keeps everything by
+		// default, but a whitelist (any include pattern present)
+		// excludes anything that didn't match one of its patterns.
+		return !hasIncludePattern
+	}
+
+	return include
+}
@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestMatchesFiltersNoPatterns(t *testing.T) {
+	if !matchesFilters("owner/repo", nil) {
+		t.Fatal("matchesFilters with no patterns should include everything")
+	}
+}
+
+func TestMatchesFiltersExcludeOnlyKeepsUnmatched(t *testing.T) {
+	patterns := []string{"!owner/secret-*"}
+
+	if !matchesFilters("owner/repo", patterns) {
+		t.Error("repo not matching the exclude pattern should be kept")
+	}
+	if matchesFilters("owner/secret-repo", patterns) {
+		t.Error("repo matching the exclude pattern should be dropped")
+	}
+}
+
+func TestMatchesFiltersWhitelistDropsUnmatched(t *testing.T) {
+	patterns := []string{"owner/*"}
+
+	if !matchesFilters("owner/repo", patterns) {
+		t.Error("repo matching the include pattern should be kept")
+	}
+	if matchesFilters("other/repo", patterns) {
+		t.Error("repo not matching any include pattern should be dropped")
+	}
+}
+
+func TestMatchesFiltersIncludeThenExcludeOverrides(t *testing.T) {
+	patterns := []string{"owner/*", "!owner/secret-*"}
+
+	if !matchesFilters("owner/repo", patterns) {
+		t.Error("repo matching only the include pattern should be kept")
+	}
+	if matchesFilters("owner/secret-repo", patterns) {
+		t.Error("repo matching a later exclude pattern should be dropped")
+	}
+}
+
+func TestMatchesFiltersLastMatchWins(t *testing.T) {
+	patterns := []string{"!owner/*", "owner/public-*"}
+
+	if !matchesFilters("owner/public-repo", patterns) {
+		t.Error("repo matching the later include pattern should be kept")
+	}
+	if matchesFilters("owner/private-repo", patterns) {
+		t.Error("repo matching only the earlier exclude pattern should be dropped")
+	}
+}
+
+func TestMatchesFiltersInvalidPatternIgnored(t *testing.T) {
+	patterns := []string{"owner/["}
+
+	if matchesFilters("owner/repo", patterns) {
+		t.Error("an unmatched, malformed pattern should not include the repo")
+	}
+}
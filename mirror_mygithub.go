@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -11,9 +12,13 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"path"
+	"strconv"
 	"strings"
-	"syscall"
+	"sync"
 	"time"
+
+	"github.com/yinheli/mirror_mygithub/retries"
 )
 
 var (
@@ -23,6 +28,11 @@ var (
 	user_repos_uri = "/user/repos"
 
 	configFile = flag.String("f", "config.json", "config file")
+	pollFlag   = flag.Duration("poll", 0, "run as a daemon, re-syncing repos on this interval (e.g. 5m). 0 means run once and exit")
+	httpAddr   = flag.String("http", "", "if set, serve mirrored repos as tarballs over HTTP on this addr (e.g. :8080), implies -poll")
+	jobsFlag   = flag.Int("j", 1, "number of repos to clone/pull concurrently")
+	bareFlag   = flag.Bool("bare", false, "clone as a full --mirror (all refs/branches/tags) instead of a regular working copy")
+	forceFlag  = flag.Bool("force", false, "ignore state.json and re-list/re-sync every repo")
 
 	cfg Config
 
@@ -32,16 +42,42 @@ var (
 type Repo struct {
 	FullName string `json:"full_name"`
 	SSHUrl   string `json:"ssh_url"`
+	CloneURL string `json:"clone_url"`
+	GitURL   string `json:"git_url"`
+	Fork     bool   `json:"fork"`
+	Archived bool   `json:"archived"`
+	Private  bool   `json:"private"`
+	PushedAt string `json:"pushed_at"`
 }
 
 func (r Repo) String() string {
 	return fmt.Sprintf("%s: %s", r.FullName, r.SSHUrl)
 }
 
+// cloneURL returns the clone URL for the configured protocol, defaulting
+// to SSH to preserve the historical behavior of this tool.
+func (r Repo) cloneURL(protocol string) string {
+	switch protocol {
+	case "https":
+		return r.CloneURL
+	case "git":
+		return r.GitURL
+	default:
+		return r.SSHUrl
+	}
+}
+
 type Config struct {
-	User        string `json:"user"`
-	Token       string `json:"token"`
-	RepoRootDir string `json:"repo_root_dir"`
+	User         string        `json:"user"`
+	Token        string        `json:"token"`
+	RepoRootDir  string        `json:"repo_root_dir"`
+	Protocol     string        `json:"protocol"`
+	SkipForks    bool          `json:"skip_forks"`
+	SkipArchived bool          `json:"skip_archived"`
+	Filters      []string      `json:"filters"`
+	BareMirror   bool          `json:"bare_mirror"`
+	Destinations []Destination `json:"destinations"`
+	HTTPToken    string        `json:"http_token"`
 }
 
 func main() {
@@ -69,6 +105,10 @@ func main() {
 		return
 	}
 
+	if *bareFlag {
+		cfg.BareMirror = true
+	}
+
 	lg.Printf("mirror mygithub start work, config(user: %v, repo_root_dir: %v)", cfg.User, cfg.RepoRootDir)
 
 	if _, err := os.Stat(cfg.RepoRootDir); os.IsNotExist(err) {
@@ -81,11 +121,145 @@ func main() {
 
 	os.Chdir(cfg.RepoRootDir)
 
-	syncRepos(fmt.Sprintf("%v/users", cfg.RepoRootDir), user_repos_uri)
-	syncRepos(fmt.Sprintf("%v/starred", cfg.RepoRootDir), starred_uri)
+	loadState()
+
+	if *httpAddr != "" && *pollFlag == 0 {
+		// serving requires a poll interval so repos actually get refreshed
+		*pollFlag = time.Minute * 10
+	}
+
+	if *pollFlag == 0 {
+		syncRepos(fmt.Sprintf("%v/users", cfg.RepoRootDir), user_repos_uri)
+		syncRepos(fmt.Sprintf("%v/starred", cfg.RepoRootDir), starred_uri)
+		lg.Println("finished")
+		return
+	}
+
+	runDaemon()
+}
+
+// runDaemon runs syncRepos forever on -poll's interval, and optionally
+// serves the mirrored repos over HTTP. It never returns.
+func runDaemon() {
+	sources := []struct {
+		rootDir string
+		apiUri  string
+	}{
+		{fmt.Sprintf("%v/users", cfg.RepoRootDir), user_repos_uri},
+		{fmt.Sprintf("%v/starred", cfg.RepoRootDir), starred_uri},
+	}
+
+	for _, s := range sources {
+		startRepoPoller(s.rootDir, s.apiUri)
+	}
+
+	if *httpAddr != "" {
+		go serveHTTP(*httpAddr)
+	}
+
+	select {}
+}
+
+// repoPoller holds the runtime state for one API listing (users or
+// starred) being kept in sync on a timer, with a tickle channel so an
+// HTTP hit can force an out-of-band refresh.
+type repoPoller struct {
+	rootDir string
+	apiUri  string
+	tickle  chan struct{}
+}
+
+var (
+	pollersMu sync.Mutex
+	pollers   []*repoPoller
+
+	statusesMu sync.Mutex
+	statuses   = map[string]*repoStatus{}
+)
+
+// repoStatus is what /status reports for a single mirrored repo.
+type repoStatus struct {
+	Repo      Repo      `json:"repo"`
+	LocalDir  string    `json:"local_dir"`
+	LastSync  time.Time `json:"last_sync"`
+	LastError string    `json:"last_error,omitempty"`
+	NextPoll  time.Time `json:"next_poll"`
+}
+
+func startRepoPoller(rootDir, apiUri string) {
+	p := &repoPoller{rootDir: rootDir, apiUri: apiUri, tickle: make(chan struct{}, 1)}
+
+	pollersMu.Lock()
+	pollers = append(pollers, p)
+	pollersMu.Unlock()
+
+	go func() {
+		for {
+			next := time.Now().Add(*pollFlag)
+			syncRepos(p.rootDir, p.apiUri)
+			recordNextPoll(p.rootDir, next)
+
+			select {
+			case <-time.After(time.Until(next)):
+			case <-p.tickle:
+				lg.Printf("tickle received, forcing refresh of %v", p.apiUri)
+			}
+		}
+	}()
+}
 
-	lg.Println("finished")
+// tickleAll coalesces a force-refresh request into every poller's
+// channel without blocking if one is already pending.
+func tickleAll() {
+	pollersMu.Lock()
+	defer pollersMu.Unlock()
+	for _, p := range pollers {
+		select {
+		case p.tickle <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func recordStatus(localDir string, repo Repo, syncErr error) {
+	statusesMu.Lock()
+	defer statusesMu.Unlock()
+
+	st, ok := statuses[repo.FullName]
+	if !ok {
+		st = &repoStatus{Repo: repo, LocalDir: localDir}
+		statuses[repo.FullName] = st
+	}
+	st.LastSync = time.Now()
+	if syncErr != nil {
+		st.LastError = syncErr.Error()
+	} else {
+		st.LastError = ""
+	}
+}
+
+func recordNextPoll(rootDir string, next time.Time) {
+	statusesMu.Lock()
+	defer statusesMu.Unlock()
+	for _, st := range statuses {
+		if strings.HasPrefix(st.LocalDir, rootDir+"/") {
+			st.NextPoll = next
+		}
+	}
+}
+
+func lookupStatus(fullName string) *repoStatus {
+	statusesMu.Lock()
+	defer statusesMu.Unlock()
+	return statuses[fullName]
+}
 
+var apiRetryPolicy = retries.Policy{
+	MaxAttempts: 8,
+	BaseDelay:   time.Second,
+	MaxDelay:    2 * time.Minute,
+	Factor:      2,
+	Jitter:      0.2,
 }
 
 func fetchApiContent(uri string) (reps []Repo) {
@@ -95,35 +269,74 @@ func fetchApiContent(uri string) (reps []Repo) {
 
 	reps = make([]Repo, 0)
 
+	firstPage := true
+	var firstPageETag string
+
 	for {
-		lg.Printf("fetch api: %s", api)
-		req, err := http.NewRequest("GET", api, nil)
-		if err != nil {
-			panic(err)
-		}
+		var content []byte
+		var link []string
+		notModified := false
+		thisPageIsFirst := firstPage
+
+		err := retries.Do(context.Background(), apiRetryPolicy, func() error {
+			lg.Printf("fetch api: %s", api)
+			req, err := http.NewRequest("GET", api, nil)
+			if err != nil {
+				return err
+			}
+
+			req.SetBasicAuth(cfg.User, cfg.Token)
+			if thisPageIsFirst && !*forceFlag {
+				if cached := cachedList(uri); cached != nil && cached.ETag != "" {
+					req.Header.Set("If-None-Match", cached.ETag)
+				}
+			}
+
+			rsp, err := client.Do(req)
+			if err != nil {
+				return &retries.TransientError{Msg: err.Error()}
+			}
+			defer rsp.Body.Close()
+
+			if thisPageIsFirst {
+				firstPageETag = rsp.Header.Get("ETag")
+			}
+
+			if rsp.StatusCode == http.StatusNotModified {
+				notModified = true
+				return nil
+			}
+
+			if rsp.StatusCode != 200 {
+				return classifyApiError(rsp)
+			}
+
+			link = strings.Split(strings.Split(rsp.Header.Get("Link"), ",")[0], ";")
+
+			content, err = ioutil.ReadAll(rsp.Body)
+			return err
+		})
 
-		req.SetBasicAuth(cfg.User, cfg.Token)
-		rsp, err := client.Do(req)
 		if err != nil {
-			lg.Fatalf("fetch api %v response error %v", uri, err)
-			return
+			if ec, ok := err.(interface{ ExitCode() int }); ok {
+				lg.Printf("[fatal] fetch api %v failed: %v", uri, err)
+				os.Exit(ec.ExitCode())
+			}
+			lg.Fatalf("fetch api %v failed after retries: %v", uri, err)
 		}
-		defer rsp.Body.Close()
 
-		if rsp.StatusCode != 200 {
-			lg.Fatalf("fetch api %v response not 200 (status: %v, msg: %v)", uri, rsp.StatusCode, rsp.Status)
-			return
+		if notModified {
+			lg.Printf("api_uri: %v unchanged since last run (304), skipping listing", uri)
+			if cached := cachedList(uri); cached != nil {
+				return cached.Repos
+			}
+			return reps
 		}
 
-		link := strings.Split(strings.Split(rsp.Header.Get("Link"), ",")[0], ";")
+		firstPage = false
 
 		api = link[0][1 : len(link[0])-1]
 
-		content, err := ioutil.ReadAll(rsp.Body)
-		if err != nil {
-			panic(err)
-		}
-
 		for _, r := range parseRepo(content) {
 			reps = append(reps, r)
 		}
@@ -137,9 +350,40 @@ func fetchApiContent(uri string) (reps []Repo) {
 
 	}
 
+	recordList(uri, firstPageETag, reps)
+
 	return
 }
 
+// classifyApiError turns a non-200 GitHub API response into a typed
+// retries error so Do knows whether to back off, sleep until the rate
+// limit resets, or give up entirely.
+func classifyApiError(rsp *http.Response) error {
+	switch rsp.StatusCode {
+	case http.StatusUnauthorized:
+		return &retries.AuthError{Msg: rsp.Status}
+	case http.StatusForbidden:
+		if rsp.Header.Get("X-RateLimit-Remaining") == "0" {
+			resetUnix, _ := strconv.ParseInt(rsp.Header.Get("X-RateLimit-Reset"), 10, 64)
+			return &retries.RateLimitedError{Reset: time.Unix(resetUnix, 0)}
+		}
+		if retryAfter := rsp.Header.Get("Retry-After"); retryAfter != "" {
+			// Secondary/abuse rate limit: no X-RateLimit-Remaining, just
+			// a Retry-After telling us how long to back off.
+			secs, err := strconv.ParseInt(retryAfter, 10, 64)
+			if err != nil {
+				secs = 60
+			}
+			return &retries.RateLimitedError{Reset: time.Now().Add(time.Duration(secs) * time.Second)}
+		}
+		return &retries.AuthError{Msg: rsp.Status}
+	case http.StatusNotFound:
+		return &retries.NotFoundError{Msg: rsp.Status}
+	default:
+		return &retries.TransientError{Msg: fmt.Sprintf("%v (status: %v)", rsp.Status, rsp.StatusCode)}
+	}
+}
+
 func parseRepo(content []byte) (repos []Repo) {
 	err := json.Unmarshal(content, &repos)
 	if err != nil {
@@ -163,67 +407,164 @@ func (p pipeWriter) String() string {
 	return p.c.String()
 }
 
-func doExec(name string, arg ...string) {
-	for i := 0; i < 20; i++ {
+var gitRetryPolicy = retries.Policy{
+	MaxAttempts: 8,
+	BaseDelay:   200 * time.Millisecond,
+	MaxDelay:    30 * time.Second,
+	Factor:      2,
+	Jitter:      0.2,
+}
+
+// doExec runs name with arg in dir, retrying transient failures and
+// aborting immediately on a DMCA takedown or auth/not-found error, which
+// retrying can never fix.
+func doExec(dir, name string, arg ...string) error {
+	return doExecEnv(dir, nil, name, arg...)
+}
 
+// doExecEnv is doExec with extra environment variables appended to the
+// child process's environment, for passing secrets that must not appear
+// in argv (and therefore not in doExec's own error logging either).
+func doExecEnv(dir string, env []string, name string, arg ...string) error {
+	return retries.Do(context.Background(), gitRetryPolicy, func() error {
 		stdout := pipeWriter{w: os.Stdout, c: &bytes.Buffer{}}
 		stderr := pipeWriter{w: os.Stderr, c: &bytes.Buffer{}}
 
 		cmd := exec.Command(name, arg...)
+		cmd.Dir = dir
 		cmd.Stdout = stdout
 		cmd.Stderr = stderr
+		if env != nil {
+			cmd.Env = append(os.Environ(), env...)
+		}
 
 		err := cmd.Run()
-
-		if err != nil {
-
-			if strings.Contains(stderr.String(), "DMCA takedown") {
-				break
-			}
-
-			if exiterr, ok := err.(*exec.ExitError); ok {
-				// The program has exited with an exit code != 0
-				// There is no plattform independent way to retrieve
-				// the exit code, but the following will work on Unix
-				if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-					if status.ExitStatus() == 1 {
-						break
-					}
-				}
-			}
-
-			lg.Printf("[error] cmd run error cmd:%v arg:%v, error: %v", name, arg, err)
-			lg.Printf("[retry] try rerun cmd: %v", cmd)
-			time.Sleep(time.Millisecond * 200)
-			continue
-		} else {
-			break
+		if err == nil {
+			return nil
 		}
 
-	}
+		classified := classifyGitError(stderr.String(), err)
+		lg.Printf("[error] cmd run error cmd:%v arg:%v, error: %v", name, arg, classified)
+		return classified
+	})
+}
 
+// classifyGitError turns a failed git invocation's stderr into a typed
+// retries error so doExec knows whether retrying could help.
+func classifyGitError(stderr string, err error) error {
+	switch {
+	case strings.Contains(stderr, "DMCA takedown"):
+		return &retries.DMCAError{Msg: strings.TrimSpace(stderr)}
+	case strings.Contains(stderr, "Authentication failed"), strings.Contains(stderr, "Permission denied (publickey)"):
+		return &retries.AuthError{Msg: strings.TrimSpace(stderr)}
+	case strings.Contains(stderr, "Repository not found"):
+		return &retries.NotFoundError{Msg: strings.TrimSpace(stderr)}
+	default:
+		return &retries.TransientError{Msg: fmt.Sprintf("%v: %v", err, strings.TrimSpace(stderr))}
+	}
 }
 
 func syncRepos(rootDir, api_uri string) {
 	lg.Printf("sync repos.... rootDir:%s, api_uri: %s", rootDir, api_uri)
 	repos := fetchApiContent(api_uri)
+	repos = filterRepos(repos)
 	lg.Printf("api_uri: %s, repo count: %v", api_uri, len(repos))
+
+	jobs := *jobsFlag
+	if jobs < 1 {
+		jobs = 1
+	}
+	sem := make(chan struct{}, jobs)
+	wg := sync.WaitGroup{}
+
 	for _, repo := range repos {
-		lg.Printf("sync repo: %v, git url: %v", repo.FullName, repo.SSHUrl)
-		localDir := fmt.Sprintf("%v/%v", rootDir, repo.FullName)
-		if _, err := os.Stat(localDir); err != nil {
-			lg.Printf("local git repo dir not found, try create: %v", localDir)
-			err = os.MkdirAll(localDir, 0700)
-			if err != nil {
-				lg.Fatalf("create local repo dir error: %v", err)
-			}
+		repo := repo
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			syncRepo(rootDir, repo)
+		}()
+	}
+
+	wg.Wait()
+	saveState()
+}
+
+func syncRepo(rootDir string, repo Repo) {
+	url := repo.cloneURL(cfg.Protocol)
+	lg.Printf("sync repo: %v, git url: %v", repo.FullName, url)
+
+	if cfg.BareMirror {
+		syncRepoBare(rootDir, repo, url)
+		return
+	}
+
+	localDir := fmt.Sprintf("%v/%v", rootDir, repo.FullName)
+	if _, err := os.Stat(localDir); err != nil {
+		lg.Printf("local git repo dir not found, try create: %v", localDir)
+		err = os.MkdirAll(localDir, 0700)
+		if err != nil {
+			lg.Fatalf("create local repo dir error: %v", err)
+		}
 
-			lg.Printf("git clone repo: %v", repo.FullName)
-			doExec("git", "clone", repo.SSHUrl, localDir)
-		} else {
-			os.Chdir(localDir)
-			doExec("git", "reset", "--hard")
-			doExec("git", "pull", "--rebase")
+		lg.Printf("git clone repo: %v", repo.FullName)
+		if err := doExec("", "git", "clone", url, localDir); err != nil {
+			recordStatus(localDir, repo, err)
+			recordRepoState(repo, localDir, err)
+			return
+		}
+	} else if !*forceFlag && unchangedSincePushed(repo) {
+		lg.Printf("repo %v unchanged since last sync (pushed_at: %v), skipping", repo.FullName, repo.PushedAt)
+		recordStatus(localDir, repo, nil)
+		return
+	} else {
+		if err := doExec(localDir, "git", "reset", "--hard"); err != nil {
+			recordStatus(localDir, repo, err)
+			recordRepoState(repo, localDir, err)
+			return
+		}
+		if err := doExec(localDir, "git", "pull", "--rebase"); err != nil {
+			recordStatus(localDir, repo, err)
+			recordRepoState(repo, localDir, err)
+			return
+		}
+	}
+	recordStatus(localDir, repo, nil)
+	recordRepoState(repo, localDir, nil)
+	pushToDestinations(localDir, repo)
+}
+
+// syncRepoBare keeps a --mirror clone of repo, which carries every ref
+// (branches, tags, notes) rather than just the checked-out default
+// branch, and is safe to re-serve via `git daemon` or push on elsewhere.
+func syncRepoBare(rootDir string, repo Repo, url string) {
+	localDir := fmt.Sprintf("%v/%v.git", rootDir, repo.FullName)
+	if _, err := os.Stat(localDir); err != nil {
+		lg.Printf("bare mirror not found, cloning: %v", localDir)
+		if err := os.MkdirAll(fmt.Sprintf("%v/%v", rootDir, path.Dir(repo.FullName)), 0700); err != nil {
+			lg.Fatalf("create local repo dir error: %v", err)
+		}
+
+		lg.Printf("git clone --mirror repo: %v", repo.FullName)
+		if err := doExec("", "git", "clone", "--mirror", url, localDir); err != nil {
+			recordStatus(localDir, repo, err)
+			recordRepoState(repo, localDir, err)
+			return
+		}
+	} else if !*forceFlag && unchangedSincePushed(repo) {
+		lg.Printf("repo %v unchanged since last sync (pushed_at: %v), skipping", repo.FullName, repo.PushedAt)
+		recordStatus(localDir, repo, nil)
+		return
+	} else {
+		if err := doExec(localDir, "git", "remote", "update", "--prune"); err != nil {
+			recordStatus(localDir, repo, err)
+			recordRepoState(repo, localDir, err)
+			return
 		}
 	}
+	recordStatus(localDir, repo, nil)
+	recordRepoState(repo, localDir, nil)
+	pushToDestinations(localDir, repo)
 }
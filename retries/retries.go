@@ -0,0 +1,124 @@
+// Package retries provides a small retry-with-backoff helper and a set
+// of typed errors so callers can tell a transient failure (worth
+// retrying) apart from a permanent one (worth aborting on) without
+// grepping stderr themselves at every call site.
+package retries
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Policy controls how Do retries a function.
+type Policy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Factor      float64
+	Jitter      float64 // fraction of the computed delay to randomize, e.g. 0.2
+}
+
+// DMCAError means the repository was taken down and retrying can never
+// succeed.
+type DMCAError struct {
+	Msg string
+}
+
+func (e *DMCAError) Error() string { return e.Msg }
+
+// AuthError means the credentials in use were rejected. Exit code 128
+// matches git's own convention for a fatal, non-retryable failure.
+type AuthError struct {
+	Msg string
+}
+
+func (e *AuthError) Error() string { return "Authentication failed: " + e.Msg }
+func (e *AuthError) ExitCode() int { return 128 }
+
+// NotFoundError means the repository doesn't exist (or isn't visible to
+// the configured token).
+type NotFoundError struct {
+	Msg string
+}
+
+func (e *NotFoundError) Error() string { return "Repository not found: " + e.Msg }
+func (e *NotFoundError) ExitCode() int { return 128 }
+
+// RateLimitedError means the call hit GitHub's rate limit. Reset is when
+// the caller should try again.
+type RateLimitedError struct {
+	Reset time.Time
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("rate limited until %v", e.Reset)
+}
+
+// TransientError is anything else that's worth retrying with backoff:
+// network blips, GitHub 5xx responses, etc.
+type TransientError struct {
+	Msg string
+}
+
+func (e *TransientError) Error() string { return e.Msg }
+
+// Do calls fn, retrying according to policy until it succeeds, a
+// DMCAError/AuthError/NotFoundError is returned (these never get better
+// on retry), ctx is canceled, or MaxAttempts is exhausted.
+func Do(ctx context.Context, policy Policy, fn func() error) error {
+	var err error
+
+	for attempt := 0; attempt < policy.MaxAttempts; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+
+		switch e := err.(type) {
+		case *DMCAError, *AuthError, *NotFoundError:
+			return err
+		case *RateLimitedError:
+			if sleepErr := sleepUntil(ctx, e.Reset); sleepErr != nil {
+				return sleepErr
+			}
+			continue
+		}
+
+		delay := backoffDelay(policy, attempt)
+		if sleepErr := sleepFor(ctx, delay); sleepErr != nil {
+			return sleepErr
+		}
+	}
+
+	return err
+}
+
+func backoffDelay(policy Policy, attempt int) time.Duration {
+	delay := float64(policy.BaseDelay) * math.Pow(policy.Factor, float64(attempt))
+	if max := float64(policy.MaxDelay); max > 0 && delay > max {
+		delay = max
+	}
+	if policy.Jitter > 0 {
+		delay += delay * policy.Jitter * (rand.Float64()*2 - 1)
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return time.Duration(delay)
+}
+
+func sleepFor(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func sleepUntil(ctx context.Context, t time.Time) error {
+	return sleepFor(ctx, time.Until(t))
+}
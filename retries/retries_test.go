@@ -0,0 +1,146 @@
+package retries
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDoReturnsNilOnFirstSuccess(t *testing.T) {
+	calls := 0
+	err := Do(context.Background(), Policy{MaxAttempts: 3, BaseDelay: time.Millisecond}, func() error {
+		calls++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Do() = %v, want nil", err)
+	}
+	if calls != 1 {
+		t.Fatalf("fn called %d times, want 1", calls)
+	}
+}
+
+func TestDoRetriesTransientErrorUntilSuccess(t *testing.T) {
+	calls := 0
+	err := Do(context.Background(), Policy{MaxAttempts: 3, BaseDelay: time.Millisecond}, func() error {
+		calls++
+		if calls < 3 {
+			return &TransientError{Msg: "blip"}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Do() = %v, want nil", err)
+	}
+	if calls != 3 {
+		t.Fatalf("fn called %d times, want 3", calls)
+	}
+}
+
+func TestDoGivesUpAfterMaxAttempts(t *testing.T) {
+	calls := 0
+	err := Do(context.Background(), Policy{MaxAttempts: 2, BaseDelay: time.Millisecond}, func() error {
+		calls++
+		return &TransientError{Msg: "still broken"}
+	})
+	if err == nil {
+		t.Fatal("Do() = nil, want error")
+	}
+	if calls != 2 {
+		t.Fatalf("fn called %d times, want 2 (MaxAttempts)", calls)
+	}
+}
+
+func TestDoAbortsImmediatelyOnNonRetryableErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+	}{
+		{"dmca", &DMCAError{Msg: "taken down"}},
+		{"auth", &AuthError{Msg: "bad token"}},
+		{"not found", &NotFoundError{Msg: "no such repo"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			calls := 0
+			err := Do(context.Background(), Policy{MaxAttempts: 5, BaseDelay: time.Millisecond}, func() error {
+				calls++
+				return c.err
+			})
+			if !errors.Is(err, c.err) && err != c.err {
+				t.Fatalf("Do() = %v, want %v", err, c.err)
+			}
+			if calls != 1 {
+				t.Fatalf("fn called %d times, want 1 (no retry)", calls)
+			}
+		})
+	}
+}
+
+func TestDoSleepsUntilRateLimitResetThenRetries(t *testing.T) {
+	calls := 0
+	reset := time.Now().Add(20 * time.Millisecond)
+	start := time.Now()
+	err := Do(context.Background(), Policy{MaxAttempts: 2, BaseDelay: time.Millisecond}, func() error {
+		calls++
+		if calls == 1 {
+			return &RateLimitedError{Reset: reset}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Do() = %v, want nil", err)
+	}
+	if calls != 2 {
+		t.Fatalf("fn called %d times, want 2", calls)
+	}
+	if time.Since(start) < 15*time.Millisecond {
+		t.Fatalf("Do() returned before rate limit reset, elapsed: %v", time.Since(start))
+	}
+}
+
+func TestDoAbortsOnContextCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	calls := 0
+	err := Do(ctx, Policy{MaxAttempts: 5, BaseDelay: time.Second}, func() error {
+		calls++
+		return &TransientError{Msg: "blip"}
+	})
+	if err != context.Canceled {
+		t.Fatalf("Do() = %v, want context.Canceled", err)
+	}
+	if calls != 1 {
+		t.Fatalf("fn called %d times, want 1", calls)
+	}
+}
+
+func TestBackoffDelayGrowsAndCapsAtMaxDelay(t *testing.T) {
+	policy := Policy{BaseDelay: 10 * time.Millisecond, Factor: 2, MaxDelay: 50 * time.Millisecond}
+
+	d0 := backoffDelay(policy, 0)
+	d1 := backoffDelay(policy, 1)
+	d5 := backoffDelay(policy, 5)
+
+	if d0 != 10*time.Millisecond {
+		t.Fatalf("backoffDelay(attempt=0) = %v, want 10ms", d0)
+	}
+	if d1 != 20*time.Millisecond {
+		t.Fatalf("backoffDelay(attempt=1) = %v, want 20ms", d1)
+	}
+	if d5 != policy.MaxDelay {
+		t.Fatalf("backoffDelay(attempt=5) = %v, want capped at %v", d5, policy.MaxDelay)
+	}
+}
+
+func TestBackoffDelayJitterStaysNonNegative(t *testing.T) {
+	policy := Policy{BaseDelay: time.Millisecond, Factor: 1, Jitter: 1}
+	for i := 0; i < 50; i++ {
+		if d := backoffDelay(policy, 0); d < 0 {
+			t.Fatalf("backoffDelay() = %v, want >= 0", d)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// serveHTTP exposes every mirrored repo as a downloadable tarball plus a
+// /status endpoint, turning the daemon into a usable local mirror
+// service instead of a cron-only helper. If cfg.HTTPToken is set, every
+// request must present it as a bearer token; private repos are hidden
+// from unauthenticated requests either way.
+func serveHTTP(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", handleStatus)
+	mux.HandleFunc("/", handleArchive)
+
+	if cfg.HTTPToken == "" {
+		lg.Printf("http: warning: no http_token configured, private repos will be hidden but public ones are served unauthenticated")
+	}
+
+	lg.Printf("http: listening on %v", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		lg.Fatalf("http: listen failed: %v", err)
+	}
+}
+
+// httpAuthorized reports whether r presents the configured HTTPToken. It
+// always returns false when no token is configured: that's the signal
+// used elsewhere to hide private repos by default rather than to treat
+// every request as privileged.
+func httpAuthorized(r *http.Request) bool {
+	if cfg.HTTPToken == "" {
+		return false
+	}
+	return r.Header.Get("Authorization") == "Bearer "+cfg.HTTPToken
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	if cfg.HTTPToken != "" && !httpAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	authorized := httpAuthorized(r)
+
+	statusesMu.Lock()
+	out := make([]*repoStatus, 0, len(statuses))
+	for _, st := range statuses {
+		if st.Repo.Private && !authorized {
+			continue
+		}
+		out = append(out, st)
+	}
+	statusesMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// handleArchive serves /<full_name>.tar.gz by streaming `git archive`
+// output for the matching local mirror. A request for a repo that
+// hasn't been synced yet tickles the pollers and waits briefly for the
+// first sync, instead of making the caller wait for the next tick.
+func handleArchive(w http.ResponseWriter, r *http.Request) {
+	fullName := strings.TrimPrefix(r.URL.Path, "/")
+	fullName = strings.TrimSuffix(fullName, ".tar.gz")
+	if fullName == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if cfg.HTTPToken != "" && !httpAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	authorized := httpAuthorized(r)
+
+	st := lookupStatus(fullName)
+	if st == nil || st.LastSync.IsZero() {
+		lg.Printf("http: %v not yet synced, tickling pollers", fullName)
+		tickleAll()
+		deadline := time.After(30 * time.Second)
+		for st == nil || st.LastSync.IsZero() {
+			select {
+			case <-deadline:
+				http.Error(w, "repo not yet mirrored, try again shortly", http.StatusServiceUnavailable)
+				return
+			case <-time.After(200 * time.Millisecond):
+				st = lookupStatus(fullName)
+			}
+		}
+	}
+
+	if st.Repo.Private && !authorized {
+		// Don't let an unauthenticated caller learn a private repo
+		// exists at all.
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+fullName+".tar.gz\"")
+
+	cmd := exec.Command("git", "archive", "--format=tar.gz", "HEAD")
+	cmd.Dir = st.LocalDir
+	cmd.Stdout = w
+	if err := cmd.Run(); err != nil {
+		lg.Printf("http: git archive failed for %v: %v", fullName, err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const stateFileName = "state.json"
+
+// listCache remembers a listing API response so an unchanged (304)
+// response can be served from disk instead of re-fetched.
+type listCache struct {
+	ETag  string `json:"etag"`
+	Repos []Repo `json:"repos"`
+}
+
+// repoState is what lets syncRepo skip a repo whose pushed_at hasn't
+// moved since the last run.
+type repoState struct {
+	PushedAt  string `json:"pushed_at"`
+	HeadSHA   string `json:"head_sha"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+type stateFile struct {
+	Lists map[string]*listCache `json:"lists"`
+	Repos map[string]*repoState `json:"repos"`
+}
+
+var (
+	stateMu sync.Mutex
+	state   = &stateFile{Lists: map[string]*listCache{}, Repos: map[string]*repoState{}}
+)
+
+func statePath() string {
+	return filepath.Join(cfg.RepoRootDir, stateFileName)
+}
+
+func loadState() {
+	content, err := ioutil.ReadFile(statePath())
+	if err != nil {
+		return
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	if err := json.Unmarshal(content, state); err != nil {
+		lg.Printf("[warn] state file corrupt, starting fresh: %v", err)
+		state = &stateFile{}
+	}
+	if state.Lists == nil {
+		state.Lists = map[string]*listCache{}
+	}
+	if state.Repos == nil {
+		state.Repos = map[string]*repoState{}
+	}
+}
+
+// saveState writes state.json atomically via a rename so a crash
+// mid-write can't leave a truncated file behind. stateMu is held across
+// the marshal, write and rename (not just the marshal) so two pollers
+// saving around the same time serialize instead of racing on the same
+// tmp path.
+func saveState() {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		lg.Printf("[error] marshal state: %v", err)
+		return
+	}
+
+	tmp := statePath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		lg.Printf("[error] write state file: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, statePath()); err != nil {
+		lg.Printf("[error] rename state file: %v", err)
+	}
+}
+
+func cachedList(uri string) *listCache {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return state.Lists[uri]
+}
+
+func recordList(uri, etag string, repos []Repo) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	state.Lists[uri] = &listCache{ETag: etag, Repos: repos}
+}
+
+// unchangedSincePushed reports whether repo's pushed_at matches what we
+// recorded on the last successful sync, meaning there's nothing new to
+// pull.
+func unchangedSincePushed(repo Repo) bool {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	st, ok := state.Repos[repo.FullName]
+	return ok && repo.PushedAt != "" && st.PushedAt == repo.PushedAt
+}
+
+func recordRepoState(repo Repo, localDir string, syncErr error) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	st, ok := state.Repos[repo.FullName]
+	if !ok {
+		st = &repoState{}
+		state.Repos[repo.FullName] = st
+	}
+	if syncErr == nil {
+		st.PushedAt = repo.PushedAt
+		if head := resolveHead(localDir); head != "" {
+			st.HeadSHA = head
+		}
+	}
+	if syncErr != nil {
+		st.LastError = syncErr.Error()
+	} else {
+		st.LastError = ""
+	}
+}
+
+func resolveHead(localDir string) string {
+	out, err := exec.Command("git", "-C", localDir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}